@@ -2,8 +2,11 @@ package main
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/big"
@@ -13,39 +16,292 @@ import (
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/protos/peer"
+	blst "github.com/supranational/blst/bindings/go"
 )
 
 var StartAmount = 75000 /// Assumed salary
-var ContractKey = "contract"
 var SenderIP = "0.0.0.0"
 var SenderPort = "0"
+var ChaincodeName = "ssdledgercc"
+
+const (
+	RoleOwner = "owner"
+	RoleUser  = "user"
+)
 
 type SimpleAsset struct {
 }
 
 type Party struct {
-	PubKey    string
-	IPAddress string
-	Port      string
+	PubKey    string `json:"pubkey"`
+	IPAddress string `json:"ip"`
+	Port      string `json:"port"`
+	Deposit   int    `json:"deposit"`
+	Role      string `json:"role"`
+	// PoP is a base64 (standard) encoded proof-of-possession signature over
+	// PubKey's own key material, required for BLS12-381 parties only (see
+	// validatePartyKey). ECDSA and Ed25519 keys need no PoP: nothing about
+	// verifying a single-signer ECDSA/Ed25519 signature lets a rogue key
+	// cancel out an honest one the way BLS aggregation does.
+	PoP string `json:"pop,omitempty"`
 }
 
 type APDL struct {
 	Status         string
-	SoftwareOwner  Party
-	SoftwareUser   Party
+	Parties        []Party
 	ContractExpiry time.Time
 	DepositAmount  int
+	Threshold      int
+	Nonce          uint64
 }
 
-// Init called with the intention to create a new NDA contract
-func (t *SimpleAsset) Init(stub shim.ChaincodeStubInterface) peer.Response {
-	// Init contract state
-	apdl := APDL{"init", Party{}, Party{}, time.Now(), 0}
-	b, err := json.Marshal(apdl)
-	err = stub.PutState(ContractKey, b)
+// License is the NFT-style token minted for a download_request (and, where
+// roles allow it, a create_agreement): ownership of the right to use the
+// software, and the deposit backing it, live here rather than on the fixed
+// "user" party of an APDL, so either can move independently via
+// transfer_license.
+type License struct {
+	ID            string
+	Owner         string // SoftwareOwner pubkey; fixed at mint, never transfers.
+	Holder        string // current rights holder pubkey; moves on transfer_license.
+	Expiry        time.Time
+	DepositAmount int
+	Revoked       bool
+	Nonce         uint64
+}
+
+// agreementKey and licenseKey namespace world-state keys per agreement, so
+// many APDLs (and the licenses minted from them) can coexist on one channel
+// instead of sharing the single "contract" key the chaincode used to.
+func agreementKey(id string) string {
+	return "apdl/" + id
+}
+
+func licenseKey(id string) string {
+	return "license/" + id
+}
+
+// licenseID derives a license's world-state id deterministically from the
+// terms of the APDL it is minted from, so the same owner/user/expiry/deposit
+// combination always maps to the same license.
+func licenseID(ownerPubKey, userPubKey string, expiry time.Time, depositAmount int) string {
+	h := sha256.Sum256([]byte(ownerPubKey + userPubKey + expiry.Format(time.RFC3339) + strconv.Itoa(depositAmount)))
+	return hex.EncodeToString(h[:])
+}
+
+// loadLicense fetches and unmarshals the license stored under id, if any.
+func loadLicense(stub shim.ChaincodeStubInterface, id string) (License, bool) {
+	b, err := stub.GetState(licenseKey(id))
+	if err != nil || len(b) == 0 {
+		return License{}, false
+	}
+	var license License
+	if err := json.Unmarshal(b, &license); err != nil {
+		return License{}, false
+	}
+	return license, true
+}
+
+// slashTarget resolves the pubkey and deposit amount that penalty/refund
+// should adjust for agreement id: the license's current Holder and deposit
+// when a license was minted (so the balance follows any transfer_license
+// calls), falling back to the apdl's own user party for agreements that
+// never minted one.
+func slashTarget(stub shim.ChaincodeStubInterface, id string, apdl APDL) (string, int, error) {
+	if license, ok := loadLicense(stub, id); ok {
+		if license.Revoked {
+			return "", 0, fmt.Errorf("[-] License %s has already been revoked; no further penalties apply", id)
+		}
+		return license.Holder, license.DepositAmount, nil
+	}
+	user, ok := partyByRole(apdl, RoleUser)
+	if !ok {
+		return "", 0, fmt.Errorf("[-] Agreement has no user party")
+	}
+	return user.PubKey, user.Deposit, nil
+}
+
+// revokeLicenseIfMinted marks id's license (if one was minted) Revoked, so
+// that license.Revoked stays the single source of truth slashTarget and
+// revoke_license both check before slashing a deposit — otherwise penalty
+// and revoke_license are two independent, unsynchronized state machines over
+// the same deposit, and whichever runs second slashes it a second time.
+func revokeLicenseIfMinted(stub shim.ChaincodeStubInterface, id string) error {
+	license, ok := loadLicense(stub, id)
+	if !ok {
+		return nil
+	}
+	license.Revoked = true
+	b, err := json.Marshal(license)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(licenseKey(id), b)
+}
+
+// mintLicense mints the NFT-style license for apdl under id when it has both
+// an owner and a user party; agreements without that shape (e.g. a
+// multi-party create_agreement with only auditor/notary roles) simply have
+// no license, and penalty/refund fall back to the apdl's own user party.
+func mintLicense(stub shim.ChaincodeStubInterface, id string, apdl APDL) error {
+	owner, ok := partyByRole(apdl, RoleOwner)
+	if !ok {
+		return nil
+	}
+	user, ok := partyByRole(apdl, RoleUser)
+	if !ok {
+		return nil
+	}
+	license := License{
+		ID:            id,
+		Owner:         owner.PubKey,
+		Holder:        user.PubKey,
+		Expiry:        apdl.ContractExpiry,
+		DepositAmount: user.Deposit,
+		Revoked:       false,
+		Nonce:         0,
+	}
+	b, err := json.Marshal(license)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(licenseKey(id), b)
+}
+
+// ChallengeWindow is how long a closed payment channel stays open to dispute
+// before its settlement is final.
+var ChallengeWindow = 24 * time.Hour
+
+// Channel is an off-chain payment channel between a software owner and user:
+// instead of one chaincode transaction per metered usage event, the two
+// parties exchange signed CumulativeOwed states off-chain and settle with a
+// single close_channel call, optionally corrected by dispute_channel within
+// ChallengeWindow.
+type Channel struct {
+	ID                string
+	Owner             string
+	User              string
+	DepositAmount     int
+	Nonce             uint64
+	CumulativeOwed    int
+	Status            string // "open", "closing"
+	ChallengeDeadline time.Time
+}
+
+func channelKey(id string) string {
+	return "channel/" + id
+}
+
+func loadChannel(stub shim.ChaincodeStubInterface, id string) (Channel, bool) {
+	b, err := stub.GetState(channelKey(id))
+	if err != nil || len(b) == 0 {
+		return Channel{}, false
+	}
+	var channel Channel
+	if err := json.Unmarshal(b, &channel); err != nil {
+		return Channel{}, false
+	}
+	return channel, true
+}
+
+// settleChannel applies the balance delta between the channel's last
+// recorded CumulativeOwed and newOwed, moving the difference from the user's
+// balance to the owner's. Called from both close_channel and dispute_channel
+// so a disputed, higher-nonce state only ever settles the incremental amount.
+func settleChannel(stub shim.ChaincodeStubInterface, channel *Channel, newOwed int) {
+	delta := newOwed - channel.CumulativeOwed
+	userValue, _ := stub.GetState(channel.User)
+	userBalance, _ := strconv.Atoi(string(userValue))
+	ownerValue, _ := stub.GetState(channel.Owner)
+	ownerBalance, _ := strconv.Atoi(string(ownerValue))
+	userBalance -= delta
+	ownerBalance += delta
+	stub.PutState(channel.User, []byte(strconv.Itoa(userBalance)))
+	stub.PutState(channel.Owner, []byte(strconv.Itoa(ownerBalance)))
+	channel.CumulativeOwed = newOwed
+}
+
+// parseChannelState validates the nonce and cumulative_owed arguments shared
+// by close_channel and dispute_channel.
+func parseChannelState(nonceStr, owedStr string, depositAmount int) (uint64, int, error) {
+	nonce, err := strconv.ParseUint(nonceStr, 10, 64)
 	if err != nil {
-		return shim.Error("[-] Failed to process download request transaction. Error!")
+		return 0, 0, fmt.Errorf("Invalid nonce passed")
+	}
+	owed, err := strconv.Atoi(owedStr)
+	if err != nil || owed < 0 || owed > depositAmount {
+		return 0, 0, fmt.Errorf("Invalid cumulative_owed passed. Must be between 0 and the channel deposit")
+	}
+	return nonce, owed, nil
+}
+
+// verifyChannelState checks that both the channel's owner and user co-signed
+// the domain-scoped digest of the given state, reusing the same M-of-N
+// verifySig used for APDL penalties with a fixed 2-of-2 party set.
+func verifyChannelState(stub shim.ChaincodeStubInterface, channel *Channel, action string, nonce uint64, owedStr, sigOwner, sigUser string) bool {
+	parties := []Party{{PubKey: channel.Owner}, {PubKey: channel.User}}
+	signatures := []string{sigOwner, sigUser}
+	digest := domainDigest(stub, action, channel.ID, nonce, owedStr)
+	return verifySig(digest, parties, signatures, 2)
+}
+
+// DomainSeparator binds a signed payload to this channel, this chaincode, and
+// a specific contract, the way EIP-155 binds an Ethereum transaction to a
+// chain ID. Including Nonce makes the separator itself advance on every
+// state-changing transaction, so a signature captured for one nonce cannot be
+// replayed once the contract has moved past it.
+type DomainSeparator struct {
+	ChainID       string
+	ChaincodeName string
+	ContractKey   string
+	Nonce         uint64
+}
+
+// lockDeposit debits amount from pubkey's current tracked balance (starting
+// from StartAmount if pubkey has no balance recorded yet) rather than
+// resetting it outright. Balances are keyed by raw pubkey with no
+// per-agreement scoping, so a party simultaneously bound to more than one
+// concurrent APDL or channel must have each deposit debited in turn, not
+// have its balance overwritten by whichever one locks a deposit last.
+func lockDeposit(stub shim.ChaincodeStubInterface, pubkey string, amount int) error {
+	balance := StartAmount
+	if value, err := stub.GetState(pubkey); err == nil && len(value) > 0 {
+		if parsed, err := strconv.Atoi(string(value)); err == nil {
+			balance = parsed
+		}
 	}
+	return stub.PutState(pubkey, []byte(strconv.Itoa(balance-amount)))
+}
+
+// partyByRole returns the first party bound to the agreement under the given
+// role (e.g. "owner", "user"). ok is false if no such party is present.
+func partyByRole(apdl APDL, role string) (Party, bool) {
+	for _, p := range apdl.Parties {
+		if p.Role == role {
+			return p, true
+		}
+	}
+	return Party{}, false
+}
+
+// domainDigest computes sha256(domainSep || action || apdlID || messageBody),
+// the value parties actually sign, scoping a signature to this channel,
+// chaincode, contract, action and nonce.
+func domainDigest(stub shim.ChaincodeStubInterface, action string, apdlID string, nonce uint64, messageBody string) []byte {
+	domain := DomainSeparator{ChainID: stub.GetChannelID(), ChaincodeName: ChaincodeName, ContractKey: apdlID, Nonce: nonce}
+	domainBytes, _ := json.Marshal(domain)
+	payload := append(domainBytes, []byte(action)...)
+	payload = append(payload, []byte(apdlID)...)
+	payload = append(payload, []byte(messageBody)...)
+	sum := sha256.Sum256(payload)
+	return sum[:]
+}
+
+// Init is called when the chaincode is instantiated; it creates no contract.
+func (t *SimpleAsset) Init(stub shim.ChaincodeStubInterface) peer.Response {
+	// Agreements are now created (and keyed) per download_request/
+	// create_agreement call rather than seeded here, so that many APDLs can
+	// coexist on one channel. Init has nothing to seed.
 	return shim.Success([]byte("[+] Init completed\n"))
 }
 
@@ -80,26 +336,97 @@ func (t *SimpleAsset) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 		}
 		senderPublicKey := args[1]
 		recipientPublicKey := args[2]
-		ds := Party{PubKey: senderPublicKey, IPAddress: SenderIP, Port: SenderPort}
-		dr := Party{PubKey: recipientPublicKey, IPAddress: args[5], Port: args[6]}
-		apdl := APDL{Status: "download_requested", SoftwareOwner: ds, SoftwareUser: dr, ContractExpiry: dt, DepositAmount: amount}
-		initialAmount := []byte(strconv.Itoa(StartAmount - amount))
-		err = stub.PutState(senderPublicKey, initialAmount)
-		err = stub.PutState(recipientPublicKey, initialAmount)
+		ds := Party{PubKey: senderPublicKey, IPAddress: SenderIP, Port: SenderPort, Deposit: amount, Role: RoleOwner}
+		dr := Party{PubKey: recipientPublicKey, IPAddress: args[5], Port: args[6], Deposit: amount, Role: RoleUser}
+		if err := validatePartyKey(ds); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := validatePartyKey(dr); err != nil {
+			return shim.Error(err.Error())
+		}
+		apdl := APDL{Status: "download_requested", Parties: []Party{ds, dr}, ContractExpiry: dt, DepositAmount: amount, Threshold: 2, Nonce: 1}
+		id := licenseID(senderPublicKey, recipientPublicKey, dt, amount)
+		if existing, err := stub.GetState(agreementKey(id)); err == nil && len(existing) > 0 {
+			return shim.Error("[-] An agreement already exists for these terms: " + id +
+				". Replaying download_request cannot resurrect a penalized/revoked agreement.")
+		}
+		err = lockDeposit(stub, senderPublicKey, amount)
+		err = lockDeposit(stub, recipientPublicKey, amount)
 		b, err := json.Marshal(apdl)
-		err = stub.PutState(ContractKey, b)
+		err = stub.PutState(agreementKey(id), b)
 		if err != nil {
 			return shim.Error("[-] Failed to process download request transaction. Error!")
 		}
+		if err := mintLicense(stub, id, apdl); err != nil {
+			return shim.Error("[-] Failed to mint license. Error!")
+		}
+		result = "[+] Download request accepted. License ID: " + id
+	} else if fn == "create_agreement" {
+		// args = [parties_json, expiry, threshold]
+		// parties_json = [{pubkey, ip, port, deposit, role}, ...]
+		if len(args) != 3 {
+			return shim.Error("Incorrect number of arguments. Got " + strconv.Itoa(len(args)) +
+				". Expecting [parties_json, expiry, threshold]")
+		}
+		var parties []Party
+		if err := json.Unmarshal([]byte(args[0]), &parties); err != nil {
+			return shim.Error("Unable to parse parties: " + err.Error())
+		}
+		if len(parties) < 2 {
+			return shim.Error("An agreement requires at least two parties")
+		}
+		threshold, err := strconv.Atoi(args[2])
+		if err != nil || threshold < 1 || threshold > len(parties) {
+			return shim.Error("Invalid threshold passed. Must be between 1 and " + strconv.Itoa(len(parties)))
+		}
+		dt, err := time.Parse("01/02/2006", args[1])
+		if err != nil {
+			return shim.Error("Unable to parse: " + args[1] + " Error: " + err.Error())
+		} else if !dt.After(time.Now()) {
+			return shim.Error("Invalid (past) time passed: " + dt.Format("01/02/2006"))
+		}
+		total := 0
+		for _, p := range parties {
+			if p.PubKey == "" || p.Role == "" {
+				return shim.Error("Each party must specify a pubkey and a role")
+			}
+			if err := validatePartyKey(p); err != nil {
+				return shim.Error(err.Error())
+			}
+			total += p.Deposit
+			if err := lockDeposit(stub, p.PubKey, p.Deposit); err != nil {
+				return shim.Error("[-] Failed to initialize party balance. Error!")
+			}
+		}
+		apdl := APDL{Status: "download_requested", Parties: parties, ContractExpiry: dt, DepositAmount: total, Threshold: threshold, Nonce: 1}
+		id := stub.GetTxID()
+		b, err := json.Marshal(apdl)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := stub.PutState(agreementKey(id), b); err != nil {
+			return shim.Error("[-] Failed to create agreement. Error!")
+		}
+		if err := mintLicense(stub, id, apdl); err != nil {
+			return shim.Error("[-] Failed to mint license. Error!")
+		}
+		result = "[+] Agreement created. ID: " + id
 	} else if fn == "penalty" {
-		// args = [{function}, message, hubSig, userSig]
+		// args = [id, nonce, message, sig_1, ..., sig_N]
+		// id is the agreement id (returned by download_request/
+		// create_agreement); nonce must match the agreement's current Nonce
+		// (see get_domain); sigs are positional, one per apdl.Parties entry,
+		// in the same order, with an empty string for a party that did not
+		// co-sign. Ed25519 and BLS12-381 signature formats are described on
+		// the scheme types and verifySig; for an ECDSA party:
 		// Xsig (where X is a party) = "rStr,sStr"
-		if len(args) != 4 {
-			return shim.Error("need to pass recipient sig")
+		if len(args) < 3 {
+			return shim.Error("need to pass id, nonce, message and party signatures")
 		}
-		contract, err := stub.GetState(ContractKey)
-		if err != nil {
-			return shim.Error("[-] Failed to get contract")
+		id := args[0]
+		contract, err := stub.GetState(agreementKey(id))
+		if err != nil || len(contract) == 0 {
+			return shim.Error("[-] Failed to get agreement: " + id)
 		}
 		var apdl APDL
 		json.Unmarshal(contract, &apdl)
@@ -107,28 +434,52 @@ func (t *SimpleAsset) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 		if apdl.Status == "init" || apdl.Status == "penalized" {
 			return shim.Error("[-] Invalid status for penalty. Current status: " + apdl.Status)
 		}
-		publicKeys := []string{apdl.SoftwareOwner.PubKey, apdl.SoftwareUser.PubKey}
-		cmp1 := apdl.SoftwareOwner.PubKey + " vs. " + args[2]
-		cmp2 := apdl.SoftwareUser.PubKey + " vs. " + args[3]
-		signatures := []string{args[2], args[3]}
-		if verifySig(args[1], publicKeys, signatures) != true {
-			return shim.Error("[-] Signature verification failed. Penalty not applied. comparisons: " + cmp1 + "---" + cmp2)
+		nonce, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return shim.Error("Invalid nonce passed")
+		}
+		if nonce != apdl.Nonce {
+			return shim.Error("[-] Stale or out-of-order nonce. Expected " + strconv.FormatUint(apdl.Nonce, 10) +
+				", got " + strconv.FormatUint(nonce, 10))
+		}
+		messageBody := args[2]
+		signatures := args[3:]
+		if len(signatures) != len(apdl.Parties) {
+			return shim.Error("Expected " + strconv.Itoa(len(apdl.Parties)) + " signature slots (use \"\" for non-signers), got " +
+				strconv.Itoa(len(signatures)))
+		}
+		digest := domainDigest(stub, "penalty", id, nonce, messageBody)
+		if !verifySig(digest, apdl.Parties, signatures, apdl.Threshold) {
+			return shim.Error("[-] Signature verification failed. Penalty not applied. Threshold " +
+				strconv.Itoa(apdl.Threshold) + " not met.")
+		}
+		holderPubKey, depositAmount, err := slashTarget(stub, id, apdl)
+		if err != nil {
+			return shim.Error(err.Error())
 		}
-		value, err := stub.GetState(apdl.SoftwareUser.PubKey)
+		value, err := stub.GetState(holderPubKey)
 		balance, _ := strconv.Atoi(string(value))
-		balance = balance - apdl.DepositAmount
+		balance = balance - depositAmount
 		endBalance := []byte(strconv.Itoa(balance))
-		stub.PutState(apdl.SoftwareUser.PubKey, endBalance)
+		stub.PutState(holderPubKey, endBalance)
+		if err := revokeLicenseIfMinted(stub, id); err != nil {
+			return shim.Error("[-] Failed to revoke license: " + err.Error())
+		}
 		apdl.Status = "penalized"
+		apdl.Nonce++
 		b, err := json.Marshal(apdl)
-		stub.PutState(ContractKey, b)
+		stub.PutState(agreementKey(id), b)
 		result = "[+] Penalty applied\n"
 
 	} else if fn == "refund" {
-		// args = [{function}]
-		contract, err := stub.GetState(ContractKey)
-		if err != nil {
-			return shim.Error(err.Error())
+		// args = [id]
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting [id]")
+		}
+		id := args[0]
+		contract, err := stub.GetState(agreementKey(id))
+		if err != nil || len(contract) == 0 {
+			return shim.Error("[-] Failed to get agreement: " + id)
 		}
 		var apdl APDL
 		json.Unmarshal(contract, &apdl)
@@ -138,24 +489,279 @@ func (t *SimpleAsset) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 		tnow := time.Now()
 		if tnow.After(apdl.ContractExpiry) {
 			apdl.Status = "expired"
+			apdl.Nonce++
 			b, _ := json.Marshal(apdl)
-			stub.PutState(ContractKey, b)
-			value, _ := stub.GetState(apdl.SoftwareUser.PubKey)
+			stub.PutState(agreementKey(id), b)
+			holderPubKey, depositAmount, err := slashTarget(stub, id, apdl)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			value, _ := stub.GetState(holderPubKey)
 			balance, _ := strconv.Atoi(string(value))
-			balance = balance + apdl.DepositAmount
+			balance = balance + depositAmount
 			endBalance := []byte(strconv.Itoa(balance))
-			stub.PutState(apdl.SoftwareUser.PubKey, endBalance)
+			stub.PutState(holderPubKey, endBalance)
+			if err := revokeLicenseIfMinted(stub, id); err != nil {
+				return shim.Error("[-] Failed to revoke license: " + err.Error())
+			}
 			result = "[+] APDL contract expired."
 		} else {
 			return shim.Error("[-] APDL contract not yet expired")
 		}
 	} else if fn == "get_status" {
-		// args = [{function}]
-		contract, err := stub.GetState(ContractKey)
+		// args = [id]
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting [id]")
+		}
+		contract, err := stub.GetState(agreementKey(args[0]))
 		if err != nil {
 			return shim.Error(err.Error())
 		}
+		if len(contract) == 0 {
+			return shim.Error("[-] No such agreement: " + args[0])
+		}
 		return shim.Success(contract)
+	} else if fn == "get_domain" {
+		// args = [id]
+		// returns the DomainSeparator clients must use (with the current
+		// Nonce) when constructing the digest for their next signed call.
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting [id]")
+		}
+		contract, err := stub.GetState(agreementKey(args[0]))
+		if err != nil || len(contract) == 0 {
+			return shim.Error("[-] No such agreement: " + args[0])
+		}
+		var apdl APDL
+		json.Unmarshal(contract, &apdl)
+		domain := DomainSeparator{ChainID: stub.GetChannelID(), ChaincodeName: ChaincodeName, ContractKey: args[0], Nonce: apdl.Nonce}
+		b, err := json.Marshal(domain)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(b)
+	} else if fn == "transfer_license" {
+		// args = [license_id, nonce, new_holder_pubkey, message, sig]
+		// sig must be from the license's current Holder.
+		if len(args) != 5 {
+			return shim.Error("Incorrect number of arguments. Expecting [license_id, nonce, new_holder_pubkey, message, sig]")
+		}
+		id := args[0]
+		nonce, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return shim.Error("Invalid nonce passed")
+		}
+		newHolder := args[2]
+		messageBody := args[3]
+		sig := args[4]
+		license, ok := loadLicense(stub, id)
+		if !ok {
+			return shim.Error("[-] No such license: " + id)
+		}
+		if license.Revoked {
+			return shim.Error("[-] License has been revoked")
+		}
+		if nonce != license.Nonce {
+			return shim.Error("[-] Stale or out-of-order nonce. Expected " + strconv.FormatUint(license.Nonce, 10) +
+				", got " + strconv.FormatUint(nonce, 10))
+		}
+		algo, keyBytes, err := decodePartyKey(Party{PubKey: license.Holder})
+		if err != nil {
+			return shim.Error("[-] Unable to decode holder public key")
+		}
+		scheme, ok := schemeFor(algo)
+		if !ok {
+			return shim.Error("[-] Unsupported signature scheme for holder key")
+		}
+		digest := domainDigest(stub, "transfer_license", id, nonce, messageBody)
+		if !scheme.Verify(keyBytes, digest, sig) {
+			return shim.Error("[-] Transfer requires a valid signature from the current holder")
+		}
+		// Move only the license's own deposit amount, adding it to whatever
+		// balance newHolder already has rather than clobbering it — newHolder
+		// may well be a party to other live agreements or channels, since
+		// balances are keyed by raw pubkey.
+		oldValue, _ := stub.GetState(license.Holder)
+		oldBalance, _ := strconv.Atoi(string(oldValue))
+		if err := stub.PutState(license.Holder, []byte(strconv.Itoa(oldBalance-license.DepositAmount))); err != nil {
+			return shim.Error("[-] Failed to debit previous holder balance. Error!")
+		}
+		newValue, _ := stub.GetState(newHolder)
+		newBalance, _ := strconv.Atoi(string(newValue))
+		if err := stub.PutState(newHolder, []byte(strconv.Itoa(newBalance+license.DepositAmount))); err != nil {
+			return shim.Error("[-] Failed to credit new holder balance. Error!")
+		}
+		license.Holder = newHolder
+		license.Nonce++
+		b, err := json.Marshal(license)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := stub.PutState(licenseKey(id), b); err != nil {
+			return shim.Error("[-] Failed to transfer license. Error!")
+		}
+		result = "[+] License transferred\n"
+	} else if fn == "revoke_license" {
+		// args = [license_id, nonce, message, sig]
+		// sig must be from the license's SoftwareOwner.
+		if len(args) != 4 {
+			return shim.Error("Incorrect number of arguments. Expecting [license_id, nonce, message, sig]")
+		}
+		id := args[0]
+		nonce, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return shim.Error("Invalid nonce passed")
+		}
+		messageBody := args[2]
+		sig := args[3]
+		license, ok := loadLicense(stub, id)
+		if !ok {
+			return shim.Error("[-] No such license: " + id)
+		}
+		if license.Revoked {
+			return shim.Error("[-] License already revoked")
+		}
+		if nonce != license.Nonce {
+			return shim.Error("[-] Stale or out-of-order nonce. Expected " + strconv.FormatUint(license.Nonce, 10) +
+				", got " + strconv.FormatUint(nonce, 10))
+		}
+		algo, keyBytes, err := decodePartyKey(Party{PubKey: license.Owner})
+		if err != nil {
+			return shim.Error("[-] Unable to decode owner public key")
+		}
+		scheme, ok := schemeFor(algo)
+		if !ok {
+			return shim.Error("[-] Unsupported signature scheme for owner key")
+		}
+		digest := domainDigest(stub, "revoke_license", id, nonce, messageBody)
+		if !scheme.Verify(keyBytes, digest, sig) {
+			return shim.Error("[-] Revocation requires a valid signature from the software owner")
+		}
+		value, _ := stub.GetState(license.Holder)
+		balance, _ := strconv.Atoi(string(value))
+		balance = balance - license.DepositAmount
+		stub.PutState(license.Holder, []byte(strconv.Itoa(balance)))
+		license.Revoked = true
+		license.Nonce++
+		b, err := json.Marshal(license)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := stub.PutState(licenseKey(id), b); err != nil {
+			return shim.Error("[-] Failed to revoke license. Error!")
+		}
+		result = "[+] License revoked\n"
+	} else if fn == "query_license" {
+		// args = [license_id]
+		if len(args) != 1 {
+			return shim.Error("Incorrect number of arguments. Expecting [license_id]")
+		}
+		b, err := stub.GetState(licenseKey(args[0]))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(b) == 0 {
+			return shim.Error("[-] No such license: " + args[0])
+		}
+		return shim.Success(b)
+	} else if fn == "open_channel" {
+		// args = [owner_pubkey, user_pubkey, deposit_amount]
+		if len(args) != 3 {
+			return shim.Error("Incorrect number of arguments. Expecting [owner_pubkey, user_pubkey, deposit_amount]")
+		}
+		ownerPk := args[0]
+		userPk := args[1]
+		deposit, err := strconv.Atoi(args[2])
+		if err != nil || deposit < 0 {
+			return shim.Error("Invalid deposit amount passed")
+		}
+		id := stub.GetTxID()
+		channel := Channel{ID: id, Owner: ownerPk, User: userPk, DepositAmount: deposit, Nonce: 0, CumulativeOwed: 0, Status: "open"}
+		if err := lockDeposit(stub, userPk, deposit); err != nil {
+			return shim.Error("[-] Failed to lock deposit. Error!")
+		}
+		b, err := json.Marshal(channel)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := stub.PutState(channelKey(id), b); err != nil {
+			return shim.Error("[-] Failed to open channel. Error!")
+		}
+		result = "[+] Channel opened. ID: " + id
+	} else if fn == "close_channel" {
+		// args = [channel_id, nonce, cumulative_owed, sig_owner, sig_user]
+		// nonce and cumulative_owed must be co-signed by both parties.
+		if len(args) != 5 {
+			return shim.Error("Incorrect number of arguments. Expecting [channel_id, nonce, cumulative_owed, sig_owner, sig_user]")
+		}
+		id := args[0]
+		channel, ok := loadChannel(stub, id)
+		if !ok {
+			return shim.Error("[-] No such channel: " + id)
+		}
+		if channel.Status != "open" {
+			return shim.Error("[-] Channel is already closing or closed. Use dispute_channel to submit a higher-nonce state.")
+		}
+		nonce, cumulativeOwed, err := parseChannelState(args[1], args[2], channel.DepositAmount)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if nonce <= channel.Nonce {
+			return shim.Error("[-] Stale or out-of-order nonce. Must be greater than " + strconv.FormatUint(channel.Nonce, 10))
+		}
+		if !verifyChannelState(stub, &channel, "close_channel", nonce, args[2], args[3], args[4]) {
+			return shim.Error("[-] Signature verification failed. Channel not closed.")
+		}
+		channel.Nonce = nonce
+		channel.Status = "closing"
+		channel.ChallengeDeadline = time.Now().Add(ChallengeWindow)
+		settleChannel(stub, &channel, cumulativeOwed)
+		b, err := json.Marshal(channel)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := stub.PutState(channelKey(id), b); err != nil {
+			return shim.Error("[-] Failed to close channel. Error!")
+		}
+		result = "[+] Channel closing. Challenge window open until " + channel.ChallengeDeadline.Format(time.RFC3339)
+	} else if fn == "dispute_channel" {
+		// args = [channel_id, nonce, cumulative_owed, sig_owner, sig_user]
+		// supersedes the last settlement with a higher-nonce state, as long as
+		// the challenge window hasn't closed.
+		if len(args) != 5 {
+			return shim.Error("Incorrect number of arguments. Expecting [channel_id, nonce, cumulative_owed, sig_owner, sig_user]")
+		}
+		id := args[0]
+		channel, ok := loadChannel(stub, id)
+		if !ok {
+			return shim.Error("[-] No such channel: " + id)
+		}
+		if channel.Status != "closing" {
+			return shim.Error("[-] Channel is not in its challenge window")
+		}
+		if time.Now().After(channel.ChallengeDeadline) {
+			return shim.Error("[-] Challenge window has closed. Settlement is final.")
+		}
+		nonce, cumulativeOwed, err := parseChannelState(args[1], args[2], channel.DepositAmount)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if nonce <= channel.Nonce {
+			return shim.Error("[-] Dispute must carry a higher nonce than " + strconv.FormatUint(channel.Nonce, 10))
+		}
+		if !verifyChannelState(stub, &channel, "dispute_channel", nonce, args[2], args[3], args[4]) {
+			return shim.Error("[-] Signature verification failed. Dispute rejected.")
+		}
+		channel.Nonce = nonce
+		settleChannel(stub, &channel, cumulativeOwed)
+		b, err := json.Marshal(channel)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := stub.PutState(channelKey(id), b); err != nil {
+			return shim.Error("[-] Failed to record dispute. Error!")
+		}
+		result = "[+] Dispute accepted. Settlement updated to nonce " + strconv.FormatUint(channel.Nonce, 10)
 	}
 	if err != nil {
 		return shim.Error(err.Error())
@@ -164,36 +770,254 @@ func (t *SimpleAsset) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
 	return shim.Success([]byte(result))
 }
 
-// message, apdl.SoftwareOwner.PubKey, apdl.SoftwareUser.PubKey, recipientSig, senderSig
-// Xsig (where X is a party) = "rStr,sStr"
-func verifySig(message string, publicKeys []string, signatures []string) bool {
-	verified := false
-	if len(publicKeys) != len(signatures) {
+// Algorithm tags the signature scheme a Party's PubKey blob was generated
+// for. It is the leading byte of that blob, except for legacy ECDSA keys
+// (see decodePartyKey), which predate the tag and remain tagless.
+type Algorithm byte
+
+const (
+	AlgoECDSA    Algorithm = 0
+	AlgoEd25519  Algorithm = 1
+	AlgoBLS12381 Algorithm = 2
+)
+
+// BLSDomainSeparationTag scopes this chaincode's BLS signatures per the
+// IETF BLS ciphersuite convention, so a signature produced for another
+// application of the same curve cannot be replayed here.
+var BLSDomainSeparationTag = []byte("SSDLEDGER-V1-BLS12381G2_XMD:SHA-256_SSWU_RO_NUL_")
+
+// BLSPoPDomainSeparationTag scopes proof-of-possession signatures separately
+// from BLSDomainSeparationTag, per the IETF BLS ciphersuite's pop-scheme
+// convention. A party's PoP is an ordinary BLS signature over its own
+// compressed public key bytes; without a distinct DST, that signature would
+// verify equally well as a real message signature (and vice versa), letting
+// one be replayed as the other.
+var BLSPoPDomainSeparationTag = []byte("SSDLEDGER-V1-BLS12381G2_XMD:SHA-256_SSWU_RO_POP_")
+
+// SignatureScheme verifies a single signature, by one signer, over a digest.
+// BLS12-381 aggregate signatures cover multiple signers at once and so are
+// verified separately, by verifyBLSAggregate rather than through this
+// interface.
+type SignatureScheme interface {
+	Verify(keyBytes []byte, digest []byte, sig string) bool
+}
+
+type ecdsaScheme struct{}
+
+// Verify expects keyBytes to be a PKIX-encoded ECDSA public key and sig to be
+// "rStr,sStr".
+func (ecdsaScheme) Verify(keyBytes []byte, digest []byte, sig string) bool {
+	publicKey, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return false
+	}
+	ecdsaKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return false
+	}
+	parts := strings.Split(sig, ",")
+	if len(parts) != 2 {
+		return false
+	}
+	r, ok := new(big.Int).SetString(parts[0], 0)
+	if !ok {
+		return false
+	}
+	s, ok := new(big.Int).SetString(parts[1], 0)
+	if !ok {
+		return false
+	}
+	return ecdsa.Verify(ecdsaKey, digest, r, s)
+}
+
+type ed25519Scheme struct{}
+
+// Verify expects keyBytes to be a raw 32-byte Ed25519 public key and sig to
+// be its signature, base64 (standard) encoded.
+func (ed25519Scheme) Verify(keyBytes []byte, digest []byte, sig string) bool {
+	if len(keyBytes) != ed25519.PublicKeySize {
+		return false
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil || len(sigBytes) != ed25519.SignatureSize {
 		return false
 	}
+	return ed25519.Verify(ed25519.PublicKey(keyBytes), digest, sigBytes)
+}
+
+// schemeFor resolves the per-signer SignatureScheme for an algorithm tag. BLS
+// has no entry here because it is only ever verified in aggregate.
+func schemeFor(algo Algorithm) (SignatureScheme, bool) {
+	switch algo {
+	case AlgoECDSA:
+		return ecdsaScheme{}, true
+	case AlgoEd25519:
+		return ed25519Scheme{}, true
+	default:
+		return nil, false
+	}
+}
 
-	for i := 0; i < len(publicKeys); i++ {
-		publicKeyBytes, err := base64.URLEncoding.DecodeString(publicKeys[i])
-		publicKey, err := x509.ParsePKIXPublicKey(publicKeyBytes)
+// decodePartyKey extracts the algorithm and key material from a Party's
+// base64(URL)-encoded PubKey blob. Keys created before algorithm tags existed
+// are raw PKIX ECDSA keys with no leading tag byte; decodePartyKey tries that
+// legacy layout first so existing download_request callers keep working
+// unmodified, then falls back to treating the first byte as an Algorithm tag
+// and the remainder as the tagged scheme's key material.
+func decodePartyKey(party Party) (Algorithm, []byte, error) {
+	blob, err := base64.URLEncoding.DecodeString(party.PubKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := x509.ParsePKIXPublicKey(blob); err == nil {
+		return AlgoECDSA, blob, nil
+	}
+	if len(blob) < 1 {
+		return 0, nil, fmt.Errorf("empty public key blob")
+	}
+	return Algorithm(blob[0]), blob[1:], nil
+}
+
+// validatePartyKey rejects a Party before it is ever persisted, if its key
+// material can't be trusted for aggregation. ECDSA and Ed25519 keys always
+// pass. BLS12-381 keys additionally require PoP: a proof-of-possession
+// signature by that key over its own compressed G1 bytes, checked as an
+// ordinary BLS signature verification against BLSPoPDomainSeparationTag
+// (the blst bindings have no dedicated PoP verifier; the IETF ciphersuite's
+// pop-scheme is itself defined this way, not as a distinct primitive).
+// Without this check, a malicious co-signer could register a crafted "rogue"
+// BLS pubkey derived from an honest party's pubkey and forge an aggregate
+// signature credited to both — verifyBLSAggregate's FastAggregateVerify only
+// provides security against that attack for pubkeys that have already passed
+// a PoP check.
+func validatePartyKey(party Party) error {
+	algo, keyBytes, err := decodePartyKey(party)
+	if err != nil {
+		return fmt.Errorf("Unable to decode public key for party %s: %v", party.PubKey, err)
+	}
+	if algo != AlgoBLS12381 {
+		return nil
+	}
+	if party.PoP == "" {
+		return fmt.Errorf("BLS12-381 party %s must supply a proof-of-possession signature", party.PubKey)
+	}
+	pk := new(blst.P1Affine).Uncompress(keyBytes)
+	if pk == nil {
+		return fmt.Errorf("Invalid BLS12-381 public key for party %s", party.PubKey)
+	}
+	popBytes, err := base64.StdEncoding.DecodeString(party.PoP)
+	if err != nil {
+		return fmt.Errorf("Invalid proof-of-possession encoding for party %s", party.PubKey)
+	}
+	pop := new(blst.P2Affine).Uncompress(popBytes)
+	if pop == nil || !pop.SigValidate(false) {
+		return fmt.Errorf("Invalid proof-of-possession signature for party %s", party.PubKey)
+	}
+	if !pop.Verify(true, pk, true, keyBytes, BLSPoPDomainSeparationTag) {
+		return fmt.Errorf("Proof-of-possession verification failed for party %s", party.PubKey)
+	}
+	return nil
+}
+
+// verifyBLSAggregate checks a single BLS12-381 aggregate signature (G2,
+// base64 standard encoded) against the fast-aggregate of keyBytesList (each a
+// compressed G1 public key). This is what lets an APDL with many BLS
+// co-signers settle for one 96-byte signature instead of N ECDSA pairs.
+func verifyBLSAggregate(keyBytesList [][]byte, digest []byte, aggSig string) bool {
+	sigBytes, err := base64.StdEncoding.DecodeString(aggSig)
+	if err != nil {
+		return false
+	}
+	sig := new(blst.P2Affine).Uncompress(sigBytes)
+	if sig == nil || !sig.SigValidate(false) {
+		return false
+	}
+	pubKeys := make([]*blst.P1Affine, 0, len(keyBytesList))
+	for _, kb := range keyBytesList {
+		pk := new(blst.P1Affine).Uncompress(kb)
+		if pk == nil {
+			return false
+		}
+		pubKeys = append(pubKeys, pk)
+	}
+	return sig.FastAggregateVerify(true, pubKeys, digest, BLSDomainSeparationTag)
+}
+
+// verifySig checks signatures over digest (the domain-scoped hash produced by
+// domainDigest) against the party set for an M-of-N threshold contract.
+// signatures must align positionally with parties; an empty string marks a
+// party that did not co-sign. A signature that verifies for one pubkey is
+// only ever counted once, and any non-empty signature that fails to parse or
+// verify fails the whole check rather than being skipped.
+//
+// BLS12-381 parties are the one exception to "one slot, one signature": since
+// a BLS signature aggregates several signers, every co-signing BLS party's
+// slot repeats the same aggregate signature string. Those slots are grouped
+// by that shared value and verified once per group with verifyBLSAggregate.
+func verifySig(digest []byte, parties []Party, signatures []string, threshold int) bool {
+	if len(parties) != len(signatures) {
+		return false
+	}
+	seen := make(map[string]bool)
+	validCount := 0
+	blsGroups := make(map[string][]Party)
+	for i, party := range parties {
+		sigStr := signatures[i]
+		if sigStr == "" {
+			continue
+		}
+		if seen[party.PubKey] {
+			continue
+		}
+		algo, keyBytes, err := decodePartyKey(party)
 		if err != nil {
 			return false
 		}
-		sig := strings.Split(signatures[i], ",")
-		if len(sig) < 2 {
+		if algo == AlgoBLS12381 {
+			blsGroups[sigStr] = append(blsGroups[sigStr], party)
+			continue
+		}
+		scheme, ok := schemeFor(algo)
+		if !ok {
+			return false
+		}
+		if !scheme.Verify(keyBytes, digest, sigStr) {
 			return false
 		}
-		r := new(big.Int)
-		r.SetString(sig[0], 0)
-		s := new(big.Int)
-		s.SetString(sig[1], 0)
-		switch publicKey := publicKey.(type) {
-		case *ecdsa.PublicKey:
-			verified = ecdsa.Verify(publicKey, []byte(message), r, s)
-		default:
+		if seen[party.PubKey] {
+			continue
+		}
+		seen[party.PubKey] = true
+		validCount++
+	}
+	for aggSig, group := range blsGroups {
+		inGroup := make(map[string]bool)
+		keyBytesList := make([][]byte, 0, len(group))
+		for _, party := range group {
+			if inGroup[party.PubKey] {
+				continue
+			}
+			inGroup[party.PubKey] = true
+			_, keyBytes, err := decodePartyKey(party)
+			if err != nil {
+				return false
+			}
+			keyBytesList = append(keyBytesList, keyBytes)
+		}
+		if len(keyBytesList) == 0 {
+			continue
+		}
+		if !verifyBLSAggregate(keyBytesList, digest, aggSig) {
 			return false
 		}
+		for _, party := range group {
+			if !seen[party.PubKey] {
+				seen[party.PubKey] = true
+				validCount++
+			}
+		}
 	}
-	return verified
+	return validCount >= threshold
 }
 
 // main function starts up the chaincode in the container during instantiate